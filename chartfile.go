@@ -0,0 +1,314 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/provenance"
+	"kubepack.dev/kubepack/pkg/lib"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DefaultVendorDir is where Vendor() downloads chart tarballs, mirroring
+	// the layout `tk tool charts vendor` uses for jsonnet vendoring.
+	DefaultVendorDir = "vendor/charts"
+	// DefaultLockfile is the file Vendor() records resolved digests into.
+	DefaultLockfile = "chartfile.lock"
+)
+
+// ChartRef declares a single chart dependency in a Chartfile.
+type ChartRef struct {
+	Repo    string `json:"repo"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// dirName returns the directory Vendor vendors r into, under vendorDir. It
+// rejects a Name/Version that would escape vendorDir (e.g. via a ".." segment
+// or an absolute path), since both ultimately come from chartfile.yaml or a
+// caller-supplied --version and are joined straight into a filesystem path.
+func (r ChartRef) dirName() (string, error) {
+	dir := filepath.Clean(fmt.Sprintf("%s-%s", r.Name, r.Version))
+	if dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) || filepath.IsAbs(dir) {
+		return "", errors.Errorf("invalid chart reference %s@%s: escapes vendor directory", r.Name, r.Version)
+	}
+	return dir, nil
+}
+
+// Chartfile is the user-editable `chartfile.yaml`: the set of charts a
+// project depends on.
+type Chartfile struct {
+	Charts []ChartRef `json:"charts"`
+}
+
+// LockedChart is a single resolved entry in chartfile.lock.
+type LockedChart struct {
+	Repo    string `json:"repo"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Digest  string `json:"digest"`
+	Path    string `json:"path"`
+}
+
+// Lockfile is the generated `chartfile.lock`: the exact, content-addressed
+// charts that satisfy a Chartfile.
+type Lockfile struct {
+	Charts []LockedChart `json:"charts"`
+}
+
+// LoadChartfile reads a Chartfile from path.
+func LoadChartfile(path string) (*Chartfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read chartfile %s", path)
+	}
+	var cf Chartfile
+	if err := yaml.Unmarshal(data, &cf); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse chartfile %s", path)
+	}
+	return &cf, nil
+}
+
+// Save writes cf back to path.
+func (cf *Chartfile) Save(path string) error {
+	data, err := yaml.Marshal(cf)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// Add declares a new chart dependency, replacing any existing entry with the
+// same name.
+func (cf *Chartfile) Add(repo, name, version string) {
+	ref := ChartRef{Repo: repo, Name: name, Version: version}
+	for i, c := range cf.Charts {
+		if c.Name == name {
+			cf.Charts[i] = ref
+			return
+		}
+	}
+	cf.Charts = append(cf.Charts, ref)
+}
+
+// Remove drops the named chart dependency, if present.
+func (cf *Chartfile) Remove(name string) error {
+	for i, c := range cf.Charts {
+		if c.Name == name {
+			cf.Charts = append(cf.Charts[:i], cf.Charts[i+1:]...)
+			return nil
+		}
+	}
+	return errors.Errorf("no chart named %q in chartfile", name)
+}
+
+// Prune removes vendored directories under vendorDir that no longer
+// correspond to an entry in cf, so stale chart versions don't linger.
+func (cf *Chartfile) Prune(vendorDir string) error {
+	keep := map[string]bool{}
+	for _, c := range cf.Charts {
+		dir, err := c.dirName()
+		if err != nil {
+			return err
+		}
+		keep[dir] = true
+	}
+
+	entries, err := os.ReadDir(vendorDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to read vendor directory %s", vendorDir)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || keep[entry.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(vendorDir, entry.Name())); err != nil {
+			return errors.Wrapf(err, "failed to prune %s", entry.Name())
+		}
+	}
+	return nil
+}
+
+// Vendor resolves every chart declared in cf against lib.DefaultRegistry,
+// packages it into vendorDir/<name>-<version>/<name>-<version>.tgz, and
+// returns a Lockfile recording the resolved digest of each tarball. The
+// vendored charts let RenderChart run in offline mode; see the package-level
+// vendorDir variable.
+func Vendor(cf *Chartfile, vendorDir string) (*Lockfile, error) {
+	lock := &Lockfile{}
+	for _, ref := range cf.Charts {
+		chrt, err := lib.DefaultRegistry.GetChart(ref.Repo, ref.Name, ref.Version)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve chart %s/%s@%s", ref.Repo, ref.Name, ref.Version)
+		}
+
+		dir, err := ref.dirName()
+		if err != nil {
+			return nil, err
+		}
+		destDir := filepath.Join(vendorDir, dir)
+		if err := os.MkdirAll(destDir, 0o755); err != nil {
+			return nil, errors.Wrapf(err, "failed to create %s", destDir)
+		}
+
+		tgzPath, err := chartutil.Save(chrt.Chart, destDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to save chart %s to %s", ref.Name, destDir)
+		}
+
+		digest, err := provenance.DigestFile(tgzPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to digest %s", tgzPath)
+		}
+
+		// Fetch the .prov file published alongside this chart, if any, so
+		// --verify has something to check later. Not every repo signs its
+		// charts, so a missing .prov is a warning, not a Vendor failure.
+		if err := fetchProvenance(ref.Repo, ref.Name, ref.Version, tgzPath); err != nil {
+			warning("no provenance file vendored for %s@%s: %v", ref.Name, ref.Version, err)
+		}
+
+		lock.Charts = append(lock.Charts, LockedChart{
+			Repo:    ref.Repo,
+			Name:    ref.Name,
+			Version: ref.Version,
+			Digest:  "sha256:" + digest,
+			Path:    tgzPath,
+		})
+	}
+	return lock, nil
+}
+
+// chartIndexEntry is the subset of a Helm repo index.yaml entry needed to
+// resolve a chart version's download URL.
+type chartIndexEntry struct {
+	Version string   `json:"version"`
+	URLs    []string `json:"urls"`
+}
+
+// repoIndex is the subset of a Helm repo's index.yaml needed to look up a
+// chart version's download URL.
+type repoIndex struct {
+	Entries map[string][]chartIndexEntry `json:"entries"`
+}
+
+// fetchProvenance downloads the .prov file published alongside name@version
+// in repo's index.yaml, if any, and writes it next to tgzPath as
+// tgzPath+".prov" so VerifyVendoredChart has something to check. It's not an
+// error for a chart to ship no provenance file; callers that need one will
+// fail at verify time instead.
+func fetchProvenance(repo, name, version, tgzPath string) error {
+	indexURL := strings.TrimSuffix(repo, "/") + "/index.yaml"
+	resp, err := http.Get(indexURL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch %s", indexURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to fetch %s: %s", indexURL, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var idx repoIndex
+	if err := yaml.Unmarshal(body, &idx); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", indexURL)
+	}
+
+	var chartURL string
+	for _, e := range idx.Entries[name] {
+		if e.Version == version && len(e.URLs) > 0 {
+			chartURL = e.URLs[0]
+			break
+		}
+	}
+	if chartURL == "" {
+		return errors.Errorf("no download URL for %s@%s in %s", name, version, indexURL)
+	}
+
+	base, err := neturl.Parse(strings.TrimSuffix(repo, "/") + "/")
+	if err != nil {
+		return err
+	}
+	resolved, err := base.Parse(chartURL)
+	if err != nil {
+		return err
+	}
+	provURL := resolved.String() + ".prov"
+
+	provResp, err := http.Get(provURL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch %s", provURL)
+	}
+	defer provResp.Body.Close()
+	if provResp.StatusCode != http.StatusOK {
+		return errors.Errorf("no provenance file published at %s: %s", provURL, provResp.Status)
+	}
+	provBody, err := io.ReadAll(provResp.Body)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(tgzPath+".prov", provBody, 0o644)
+}
+
+// LoadVendoredChart loads a chart previously vendored by Vendor from
+// vendorDir, without touching the network. It returns an error if the chart
+// hasn't been vendored.
+func LoadVendoredChart(vendorDir, name, version string) (*chart.Chart, error) {
+	path, err := VendoredChartPath(vendorDir, name, version)
+	if err != nil {
+		return nil, err
+	}
+	if verifyProv {
+		if err := VerifyVendoredChart(path, keyringPath); err != nil {
+			return nil, err
+		}
+	}
+	return loader.Load(path)
+}
+
+// VendoredChartPath returns the path of the chart tarball Vendor() would have
+// written for name@version under vendorDir, erroring if it isn't there.
+func VendoredChartPath(vendorDir, name, version string) (string, error) {
+	ref := ChartRef{Name: name, Version: version}
+	dir, err := ref.dirName()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(vendorDir, dir, fmt.Sprintf("%s-%s.tgz", name, version))
+	if _, err := os.Stat(path); err != nil {
+		return "", errors.Wrapf(err, "chart %s@%s is not vendored in %s", name, version, vendorDir)
+	}
+	return path, nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/fatih/color"
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"kubepack.dev/lib-helm/pkg/action"
+	"sigs.k8s.io/yaml"
+)
+
+// noisyLabels are the labels Helm itself injects into every rendered object.
+// They're real, but they change on every `helm.sh/chart` bump and carry no
+// information about what the chart author actually changed, so DiffCharts
+// strips them by default.
+var noisyLabels = []string{"helm.sh/chart", "app.kubernetes.io/managed-by"}
+
+// objectKey identifies a rendered Kubernetes object independent of which
+// template file it came from, so DiffCharts can match objects across two
+// renders even if a chart upgrade moved a resource to a different file.
+type objectKey struct {
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+}
+
+func (k objectKey) String() string {
+	ns := k.Namespace
+	if ns == "" {
+		ns = "-"
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", k.APIVersion, k.Kind, ns, k.Name)
+}
+
+// FileDiff is the diff of a single rendered object between two renders.
+type FileDiff struct {
+	// Status is "added", "removed", or "changed".
+	Status string `json:"status"`
+	// Diff is a unified diff of the object's YAML, empty lines of context
+	// included. Objects whose content didn't change get no FileDiff at all.
+	Diff string `json:"diff,omitempty"`
+}
+
+// DiffCharts renders oldOpts and newOpts via RenderChart, matches up the
+// resulting objects by {apiVersion, kind, namespace, name} rather than by
+// template filename, and returns a FileDiff for every object that was added,
+// removed, or changed. If ignoreHelmLabels is set, the helm.sh/chart and
+// app.kubernetes.io/managed-by labels Helm injects are stripped before
+// comparing, so a chart version bump alone doesn't show up as noise on every
+// object.
+func DiffCharts(oldOpts, newOpts *action.InstallOptions, ignoreHelmLabels bool) (map[string]FileDiff, error) {
+	_, oldFiles, err := RenderChart(&RenderOptions{InstallOptions: oldOpts})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to render old chart")
+	}
+	_, newFiles, err := RenderChart(&RenderOptions{InstallOptions: newOpts})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to render new chart")
+	}
+
+	oldObjs, err := groupByObject(oldFiles, ignoreHelmLabels)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse old manifests")
+	}
+	newObjs, err := groupByObject(newFiles, ignoreHelmLabels)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse new manifests")
+	}
+
+	diffs := map[string]FileDiff{}
+	for key, oldContent := range oldObjs {
+		newContent, ok := newObjs[key]
+		if !ok {
+			diffs[key.String()] = FileDiff{Status: "removed", Diff: unifiedDiff(key, oldContent, "")}
+			continue
+		}
+		if oldContent != newContent {
+			diffs[key.String()] = FileDiff{Status: "changed", Diff: unifiedDiff(key, oldContent, newContent)}
+		}
+	}
+	for key, newContent := range newObjs {
+		if _, ok := oldObjs[key]; !ok {
+			diffs[key.String()] = FileDiff{Status: "added", Diff: unifiedDiff(key, "", newContent)}
+		}
+	}
+
+	return diffs, nil
+}
+
+// groupByObject parses each rendered manifest in files and indexes it by
+// objectKey, optionally stripping noisyLabels first.
+func groupByObject(files map[string]string, ignoreHelmLabels bool) (map[objectKey]string, error) {
+	objs := make(map[objectKey]string, len(files))
+	for name, content := range files {
+		var obj map[string]interface{}
+		if err := yaml.Unmarshal([]byte(content), &obj); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", name)
+		}
+		if obj == nil {
+			continue
+		}
+
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		key := objectKey{
+			APIVersion: toString(obj["apiVersion"]),
+			Kind:       toString(obj["kind"]),
+			Namespace:  toString(metadata["namespace"]),
+			Name:       toString(metadata["name"]),
+		}
+
+		if ignoreHelmLabels {
+			if labels, ok := metadata["labels"].(map[string]interface{}); ok {
+				for _, l := range noisyLabels {
+					delete(labels, l)
+				}
+				if len(labels) == 0 {
+					delete(metadata, "labels")
+				}
+			}
+		}
+
+		normalized, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to normalize %s", name)
+		}
+		objs[key] = string(normalized)
+	}
+	return objs, nil
+}
+
+func toString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func unifiedDiff(key objectKey, oldContent, newContent string) string {
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(oldContent),
+		B:        difflib.SplitLines(newContent),
+		FromFile: key.String(),
+		ToFile:   key.String(),
+		Context:  3,
+	}
+	text, _ := difflib.GetUnifiedDiffString(diff)
+	return text
+}
+
+// FormatDiffs renders the result of DiffCharts either as JSON, for machine
+// consumers, or as colored unified diff text, for a human reviewing an
+// upgrade before applying it.
+func FormatDiffs(diffs map[string]FileDiff, asJSON bool) (string, error) {
+	if asJSON {
+		data, err := json.MarshalIndent(diffs, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	keys := make([]string, 0, len(diffs))
+	for key := range diffs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		d := diffs[key]
+		switch d.Status {
+		case "added":
+			fmt.Fprintln(&buf, color.GreenString("+ %s (added)", key))
+		case "removed":
+			fmt.Fprintln(&buf, color.RedString("- %s (removed)", key))
+		default:
+			fmt.Fprintln(&buf, color.YellowString("~ %s (changed)", key))
+		}
+		for _, line := range difflib.SplitLines(d.Diff) {
+			switch {
+			case bytes.HasPrefix([]byte(line), []byte("+")):
+				buf.WriteString(color.GreenString("%s", line))
+			case bytes.HasPrefix([]byte(line), []byte("-")):
+				buf.WriteString(color.RedString("%s", line))
+			default:
+				buf.WriteString(line)
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String(), nil
+}
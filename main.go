@@ -18,13 +18,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"k8s.io/klog/v2"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/go-logr/logr/funcr"
 	"github.com/pkg/errors"
 	flag "github.com/spf13/pflag"
 	ha "helm.sh/helm/v3/pkg/action"
@@ -35,6 +41,7 @@ import (
 	"kubepack.dev/kubepack/pkg/lib"
 	"kubepack.dev/lib-helm/pkg/action"
 	"kubepack.dev/lib-helm/pkg/values"
+	"sigs.k8s.io/yaml"
 )
 
 var (
@@ -47,7 +54,17 @@ var (
 	// version = "8.1.1"
 
 	skipTests bool
-	showFiles []string = []string{"templates/deployment.yaml"}
+
+	// vendorDir, if set, makes RenderChart prefer a chart previously fetched
+	// by Vendor() under this directory over reaching out to ChartURL, so
+	// builds can run offline once `go run . --vendor` (or equivalent) has
+	// populated it.
+	vendorDir string
+
+	// sbomOut, if set, makes RenderChart write a CycloneDX SBOM for the
+	// rendered chart (subchart dependencies and referenced container images)
+	// to this path.
+	sbomOut string
 )
 
 func debug(format string, v ...interface{}) {
@@ -127,16 +144,146 @@ func m2(opts *action.InstallOptions) (*release.Release, error) {
 }
 
 func main() {
+	var releaseFile, outputDir string
+	var concurrency int
+	var chartfilePath string
+	var vendor bool
+	var serveAddr string
+	var cacheSize int
+	var requestTimeout time.Duration
+	var diffAgainst string
+	var diffJSON bool
+	var diffIgnoreHelmLabels bool
+	var showFiles []string
+	var kustomizeDir string
+
 	flag.StringVar(&url, "url", url, "Chart repo url")
 	flag.StringVar(&name, "name", name, "Name of bundle")
 	flag.StringVar(&version, "version", version, "Version of bundle")
+	flag.StringArrayVarP(&showFiles, "show-only", "s", nil, "only show manifests rendered from the given templates; unset renders every template, like `helm template`")
+	flag.StringVar(&kustomizeDir, "kustomize-dir", "", "if set, post-render the rendered manifests through the kustomization.yaml in this directory")
+	flag.StringVar(&releaseFile, "release-file", "", "render every release declared in this helmfile-style YAML file, instead of a single chart")
+	flag.StringVar(&outputDir, "output-dir", "", "with --release-file, write rendered manifests under <output-dir>/<namespace>/<release>/ instead of printing filenames")
+	flag.IntVar(&concurrency, "concurrency", 4, "with --release-file, the number of releases to render at once")
+	flag.StringVar(&chartfilePath, "chartfile", "chartfile.yaml", "path to the Chartfile consulted by --vendor")
+	flag.StringVar(&vendorDir, "vendor-dir", "", "if set, RenderChart prefers charts already vendored under this directory over fetching from --url")
+	flag.BoolVar(&vendor, "vendor", false, "resolve and download every chart in --chartfile into --vendor-dir, writing chartfile.lock, then exit")
+	flag.BoolVar(&verifyProv, "verify", false, "fail closed unless the vendored chart's .prov signature verifies against --keyring")
+	flag.StringVar(&keyringPath, "keyring", "", "path to the PGP keyring used by --verify")
+	flag.StringVar(&sbomOut, "sbom-out", "", "write a CycloneDX SBOM for the rendered chart to this path")
+	flag.StringVar(&serveAddr, "serve", "", "if set, run an HTTP render-as-a-service on this address (e.g. :8080) instead of rendering once")
+	flag.IntVar(&cacheSize, "cache-size", 128, "with --serve, the number of rendered results to keep in the in-memory LRU cache")
+	flag.DurationVar(&requestTimeout, "request-timeout", 30*time.Second, "with --serve, the per-request timeout")
+	flag.StringVar(&diffAgainst, "diff-against", "", "if set, also render the chart at this version and print a semantic diff against --version instead of rendering once")
+	flag.BoolVar(&diffJSON, "diff-json", false, "with --diff-against, emit the diff as JSON instead of colored text")
+	flag.BoolVar(&diffIgnoreHelmLabels, "diff-ignore-helm-labels", true, "with --diff-against, suppress noise from the helm.sh/chart and app.kubernetes.io/managed-by labels Helm injects")
 	flag.Parse()
 
-	namespace := "default"
-	opts := &action.InstallOptions{
+	if serveAddr != "" {
+		// The server runs unattended, so its logs go to a log aggregator
+		// rather than a terminal: emit them as one JSON object per line
+		// instead of klog's default human-readable text format.
+		klog.SetLogger(funcr.NewJSON(func(obj string) { fmt.Println(obj) }, funcr.Options{}))
+
+		srv := NewServer(cacheSize, requestTimeout)
+		klog.InfoS("starting render-as-a-service", "addr", serveAddr)
+		klog.Fatal(http.ListenAndServe(serveAddr, srv.Handler()))
+	}
+
+	if vendor {
+		dir := vendorDir
+		if dir == "" {
+			dir = DefaultVendorDir
+		}
+		cf, err := LoadChartfile(chartfilePath)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		lock, err := Vendor(cf, dir)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		if err := cf.Prune(dir); err != nil {
+			klog.Fatal(err)
+		}
+		data, err := yaml.Marshal(lock)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		if err := os.WriteFile(DefaultLockfile, data, 0o644); err != nil {
+			klog.Fatal(err)
+		}
+		return
+	}
+
+	if releaseFile != "" {
+		rf, err := LoadReleaseFile(releaseFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		results, err := RenderReleaseFile(rf, concurrency)
+		if err != nil {
+			klog.Error(err)
+		}
+		if outputDir != "" {
+			if err := WriteReleaseTree(results, outputDir); err != nil {
+				klog.Fatal(err)
+			}
+		} else {
+			for relName, res := range results {
+				if res.Err != nil {
+					continue
+				}
+				for filename := range res.Files {
+					fmt.Printf("%s/%s/%s\n", res.Release.Namespace, relName, filename)
+				}
+			}
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if diffAgainst != "" {
+		diffs, err := DiffCharts(buildInstallOptions(diffAgainst), buildInstallOptions(version), diffIgnoreHelmLabels)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		out, err := FormatDiffs(diffs, diffJSON)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		fmt.Println(out)
+		return
+	}
+
+	var postRenderer PostRenderer
+	if kustomizeDir != "" {
+		pr, err := NewKustomizePostRenderer(kustomizeDir)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		postRenderer = pr
+	}
+
+	_, files, err := RenderChart(&RenderOptions{InstallOptions: buildInstallOptions(version), ShowFiles: showFiles, PostRenderer: postRenderer})
+	if err != nil {
+		klog.Fatal(err)
+	}
+	for filename := range files {
+		fmt.Println(filename)
+	}
+}
+
+// buildInstallOptions returns the action.InstallOptions used to render the
+// chart named by the package-level url/name flags at the given version, e.g.
+// to render the same chart at two different versions for DiffCharts.
+func buildInstallOptions(ver string) *action.InstallOptions {
+	return &action.InstallOptions{
 		ChartURL:  url,
 		ChartName: name,
-		Version:   version,
+		Version:   ver,
 		Values: values.Options{
 			ValuesFile:  "",
 			ValuesPatch: nil,
@@ -148,23 +295,37 @@ func main() {
 		Wait:         false,
 		Devel:        false,
 		Timeout:      0,
-		Namespace:    namespace,
+		Namespace:    "default",
 		ReleaseName:  "release-name",
 		Atomic:       false,
 		IncludeCRDs:  false, //
 		SkipCRDs:     true,  //
 	}
+}
 
-	_, files, err := RenderChart(opts)
-	if err != nil {
-		klog.Fatal(err)
-	}
-	for filename := range files {
-		fmt.Println(filename)
-	}
+// RenderOptions wraps the external action.InstallOptions with the per-call
+// knobs RenderChart needs that InstallOptions has no field for (it's defined
+// in kubepack.dev/lib-helm and can't be extended directly from this repo).
+// Unlike the process-wide vendorDir/sbomOut settings, ShowFiles can
+// legitimately differ between concurrent RenderChart calls (see
+// RenderReleaseFile, Server.handleRender), so it lives here instead of in a
+// shared package-level variable.
+type RenderOptions struct {
+	*action.InstallOptions
+
+	// ShowFiles restricts RenderChart's output to the templates matching
+	// these exact paths or globs (e.g. "templates/*.yaml",
+	// "charts/subchart/templates/deployment.yaml"), mirroring Helm's own
+	// `helm template -s/--show-only`. Left unset, RenderChart returns every
+	// rendered template, matching `helm template`'s own default.
+	ShowFiles []string
+
+	// PostRenderer, if set, runs over the assembled manifest buffer before
+	// it's split and filtered by ShowFiles.
+	PostRenderer PostRenderer
 }
 
-func RenderChart(opts *action.InstallOptions) (string, map[string]string, error) {
+func RenderChart(opts *RenderOptions) (string, map[string]string, error) {
 	cfg := new(ha.Configuration)
 	// TODO: Use secret driver for which namespace?
 	err := cfg.Init(nil, opts.Namespace, "secret", debug)
@@ -194,12 +355,25 @@ func RenderChart(opts *action.InstallOptions) (string, map[string]string, error)
 	cmd.CreateNamespace = opts.CreateNamespace
 	cmd.Namespace = opts.Namespace
 
-	// Check chart dependencies to make sure all are present in /charts
-	chrt, err := lib.DefaultRegistry.GetChart(opts.ChartURL, opts.ChartName, opts.Version)
-	if err != nil {
-		return "", nil, err
+	// Prefer a chart already vendored by Vendor() so offline/CI builds don't
+	// need to reach ChartURL at all. A failure to load or verify the vendored
+	// chart is fatal rather than a fallback to the network: if the caller
+	// asked for vendorDir (and --verify), a tampered or missing vendored
+	// chart must not be silently replaced by whatever the network serves.
+	var chrt *chart.Chart
+	if vendorDir != "" {
+		chrt, err = LoadVendoredChart(vendorDir, opts.ChartName, opts.Version)
+		if err != nil {
+			return "", nil, err
+		}
+	} else {
+		ext, fetchErr := lib.DefaultRegistry.GetChart(opts.ChartURL, opts.ChartName, opts.Version)
+		if fetchErr != nil {
+			return "", nil, fetchErr
+		}
+		chrt = ext.Chart
 	}
-	if err := checkIfInstallable(chrt.Chart); err != nil {
+	if err := checkIfInstallable(chrt); err != nil {
 		return "", nil, err
 	}
 
@@ -211,7 +385,7 @@ func RenderChart(opts *action.InstallOptions) (string, map[string]string, error)
 		// If CheckDependencies returns an error, we have unfulfilled dependencies.
 		// As of Helm 2.4.0, this is treated as a stopping condition:
 		// https://github.com/helm/helm/issues/2209
-		if err := ha.CheckDependencies(chrt.Chart, req); err != nil {
+		if err := ha.CheckDependencies(chrt, req); err != nil {
 			err = errors.Wrap(err, "An error occurred while checking for chart dependencies. You may need to run `helm dependency build` to fetch missing dependencies")
 			if err != nil {
 				return "", nil, err
@@ -219,13 +393,13 @@ func RenderChart(opts *action.InstallOptions) (string, map[string]string, error)
 		}
 	}
 
-	vals, err := opts.Values.MergeValues(chrt.Chart)
+	vals, err := opts.Values.MergeValues(chrt)
 	if err != nil {
 		return "", nil, err
 	}
-	chrt.Chart.Values = map[string]interface{}{}
+	chrt.Values = map[string]interface{}{}
 
-	rel, err := cmd.Run(chrt.Chart, vals)
+	rel, err := cmd.Run(chrt, vals)
 	if err != nil {
 		return "", nil, err
 	}
@@ -241,13 +415,28 @@ func RenderChart(opts *action.InstallOptions) (string, map[string]string, error)
 		}
 	}
 
+	if opts.PostRenderer != nil {
+		post, err := opts.PostRenderer.Run(&manifests)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "failed to run post-renderer")
+		}
+		manifests = *post
+	}
+
 	files := map[string]string{}
 
 	// This is necessary to ensure consistent manifest ordering when using --show-only
 	// with globs or directory names.
 	splitManifests := releaseutil.SplitManifests(manifests.String())
+	manifestKeys := make([]string, 0, len(splitManifests))
+	for k := range splitManifests {
+		manifestKeys = append(manifestKeys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(manifestKeys))
+
 	manifestNameRegex := regexp.MustCompile("# Source: [^/]+/(.+)")
-	for _, manifest := range splitManifests {
+	for _, key := range manifestKeys {
+		manifest := splitManifests[key]
 		submatch := manifestNameRegex.FindStringSubmatch(manifest)
 		if len(submatch) == 0 {
 			continue
@@ -263,6 +452,65 @@ func RenderChart(opts *action.InstallOptions) (string, map[string]string, error)
 		files[manifestPath] = manifest
 	}
 
+	if sbomOut != "" {
+		sbom, err := GenerateSBOM(chrt, files)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "failed to generate SBOM")
+		}
+		data, err := json.MarshalIndent(sbom, "", "  ")
+		if err != nil {
+			return "", nil, errors.Wrap(err, "failed to marshal SBOM")
+		}
+		if err := os.WriteFile(sbomOut, data, 0o644); err != nil {
+			return "", nil, errors.Wrap(err, "failed to write SBOM")
+		}
+	}
+
+	// If ShowFiles is set, restrict the output to the templates matching the
+	// given exact paths or globs, in their original render order, and fail if
+	// any pattern matches nothing (mirrors `helm template -s`). manifestKeys
+	// drives the outer loop, not opts.ShowFiles, so the output order tracks
+	// the chart's own render order regardless of the order patterns were
+	// passed in.
+	if len(opts.ShowFiles) > 0 {
+		patterns := make([]string, len(opts.ShowFiles))
+		for i, pattern := range opts.ShowFiles {
+			patterns[i] = filepath.ToSlash(pattern)
+		}
+		matched := make([]bool, len(patterns))
+
+		var out bytes.Buffer
+		selected := map[string]string{}
+		for _, key := range manifestKeys {
+			manifest := splitManifests[key]
+			submatch := manifestNameRegex.FindStringSubmatch(manifest)
+			if len(submatch) == 0 {
+				continue
+			}
+			manifestPath := strings.Join(strings.Split(submatch[1], "/"), "/")
+
+			include := false
+			for i, pattern := range patterns {
+				if ok, _ := filepath.Match(pattern, manifestPath); ok {
+					matched[i] = true
+					include = true
+				}
+			}
+			if include {
+				selected[manifestPath] = files[manifestPath]
+				_, _ = fmt.Fprintf(&out, "---\n%s\n", manifest)
+			}
+		}
+
+		for i, ok := range matched {
+			if !ok {
+				return "", nil, errors.Errorf("could not find template %s in chart", patterns[i])
+			}
+		}
+
+		return out.String(), selected, nil
+	}
+
 	return manifests.String(), files, nil
 }
 
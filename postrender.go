@@ -0,0 +1,134 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// PostRenderer mirrors helm.sh/helm/v3/pkg/postrender.PostRenderer so that
+// anything written against Helm's own post-render contract plugs in here
+// unchanged.
+type PostRenderer interface {
+	// Run expects a single buffer filled with Helm rendered manifests. It
+	// expects the modified results to be returned on a separate buffer or an
+	// error if there was an issue or failure while running the post render step.
+	Run(renderedManifests *bytes.Buffer) (modifiedManifests *bytes.Buffer, err error)
+}
+
+const kustomizeRenderedManifestsFile = "helm-rendered.yaml"
+
+// kustomizePostRenderer patches the rendered manifests of a chart through a
+// user-supplied kustomization.yaml, so users can adjust labels, images and
+// namespaces on charts they don't own without forking them.
+type kustomizePostRenderer struct {
+	// kustomizationDir holds the user-supplied kustomization.yaml (and any
+	// patches/resources it references).
+	kustomizationDir string
+	binaryPath       string
+}
+
+// NewKustomizePostRenderer returns a PostRenderer that runs the Helm rendered
+// manifests through the kustomization.yaml found in kustomizationDir. The
+// kustomization.yaml must list kustomizeRenderedManifestsFile ("helm-rendered.yaml")
+// as one of its resources.
+func NewKustomizePostRenderer(kustomizationDir string) (PostRenderer, error) {
+	if _, err := os.Stat(filepath.Join(kustomizationDir, "kustomization.yaml")); err != nil {
+		return nil, errors.Wrapf(err, "missing kustomization.yaml in %s", kustomizationDir)
+	}
+	binaryPath, err := exec.LookPath("kustomize")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find kustomize binary in PATH")
+	}
+	return &kustomizePostRenderer{
+		kustomizationDir: kustomizationDir,
+		binaryPath:       binaryPath,
+	}, nil
+}
+
+func (p *kustomizePostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	workDir, err := os.MkdirTemp("", "helm-template-demo-kustomize-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create kustomize working directory")
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := copyDir(p.kustomizationDir, workDir); err != nil {
+		return nil, errors.Wrap(err, "failed to stage kustomization directory")
+	}
+	if err := os.WriteFile(filepath.Join(workDir, kustomizeRenderedManifestsFile), renderedManifests.Bytes(), 0o644); err != nil {
+		return nil, errors.Wrap(err, "failed to write rendered manifests for kustomize")
+	}
+
+	cmd := exec.Command(p.binaryPath, "build", workDir)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "error while running kustomize. error output:\n%s", stderr.String())
+	}
+	return &out, nil
+}
+
+// copyDir copies the files under src into dst. Nested directories (e.g. patch
+// subfolders) are copied recursively.
+func copyDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		dstPath := filepath.Join(dst, entry.Name())
+		if entry.IsDir() {
+			if err := os.MkdirAll(dstPath, 0o755); err != nil {
+				return err
+			}
+			if err := copyDir(srcPath, dstPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := copyFile(srcPath, dstPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,270 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"kubepack.dev/lib-helm/pkg/action"
+	"kubepack.dev/lib-helm/pkg/values"
+	"sigs.k8s.io/yaml"
+)
+
+// ReleaseSpec describes a single chart to render as part of a ReleaseFile,
+// similar to a release entry in a helmfile.yaml.
+type ReleaseSpec struct {
+	// Name identifies this release within the file, so other releases can
+	// depend on it via Needs.
+	Name string `json:"name"`
+
+	Repo        string   `json:"repo"`
+	Chart       string   `json:"chart"`
+	Version     string   `json:"version"`
+	Namespace   string   `json:"namespace"`
+	ReleaseName string   `json:"releaseName"`
+	ValuesFile  string   `json:"valuesFile,omitempty"`
+	Values      []string `json:"values,omitempty"`
+
+	// Needs lists the names of releases that must be rendered before this
+	// one. Releases with no ordering between them may render concurrently.
+	Needs []string `json:"needs,omitempty"`
+}
+
+// ReleaseFile is the top-level document accepted by RenderReleaseFile, e.g.:
+//
+//	releases:
+//	- name: ui-server
+//	  repo: https://charts.appscode.com/stable/
+//	  chart: kube-ui-server
+//	  version: v2022.04.04
+//	  namespace: kubeops
+//	  releaseName: ui-server
+//	- name: ui-server-dashboard
+//	  needs: [ui-server]
+//	  ...
+type ReleaseFile struct {
+	Releases []ReleaseSpec `json:"releases"`
+}
+
+// LoadReleaseFile reads and parses a ReleaseFile from path.
+func LoadReleaseFile(path string) (*ReleaseFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read release file %s", path)
+	}
+	var rf ReleaseFile
+	if err := yaml.Unmarshal(data, &rf); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse release file %s", path)
+	}
+	return &rf, nil
+}
+
+// installOptions converts a ReleaseSpec into the action.InstallOptions that
+// RenderChart expects.
+func (r ReleaseSpec) installOptions() *action.InstallOptions {
+	return &action.InstallOptions{
+		ChartURL:    r.Repo,
+		ChartName:   r.Chart,
+		Version:     r.Version,
+		Namespace:   r.Namespace,
+		ReleaseName: r.ReleaseName,
+		Values: values.Options{
+			ValuesFile: r.ValuesFile,
+			Values:     r.Values,
+		},
+		ClientOnly:  true,
+		DryRun:      true,
+		Replace:     true,
+		SkipCRDs:    true,
+		IncludeCRDs: false,
+	}
+}
+
+// ReleaseResult is the rendered output of a single ReleaseSpec.
+type ReleaseResult struct {
+	Release ReleaseSpec
+	Files   map[string]string
+	Err     error
+}
+
+// ReleaseError aggregates the per-release failures from RenderReleaseFile so
+// callers can tell which release(s) in the file failed to render.
+type ReleaseError struct {
+	Failures map[string]error
+}
+
+func (e *ReleaseError) Error() string {
+	return fmt.Sprintf("failed to render %d release(s): %v", len(e.Failures), e.Failures)
+}
+
+// RenderReleaseFile renders every release in rf, honoring the dependency
+// order expressed via ReleaseSpec.Needs, and fans out independent releases
+// across a worker pool bounded by concurrency. It returns the per-release
+// results keyed by release name; releases that depend (directly or
+// transitively) on a failed release are skipped and reported as part of the
+// returned *ReleaseError.
+func RenderReleaseFile(rf *ReleaseFile, concurrency int) (map[string]*ReleaseResult, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	byName := make(map[string]ReleaseSpec, len(rf.Releases))
+	for _, r := range rf.Releases {
+		byName[r.Name] = r
+	}
+	batches, err := batchByNeeds(rf.Releases)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]*ReleaseResult, len(rf.Releases))
+	var mu sync.Mutex
+	sem := make(chan struct{}, concurrency)
+
+	for _, batch := range batches {
+		var wg sync.WaitGroup
+		for _, name := range batch {
+			r := byName[name]
+
+			// If any prerequisite failed (or was itself skipped), skip this
+			// release rather than rendering against a partially-failed stack.
+			if skipped := failedNeed(r, results); skipped != "" {
+				mu.Lock()
+				results[r.Name] = &ReleaseResult{Release: r, Err: errors.Errorf("skipped: dependency %q failed to render", skipped)}
+				mu.Unlock()
+				continue
+			}
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(r ReleaseSpec) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				_, files, err := RenderChart(&RenderOptions{InstallOptions: r.installOptions()})
+
+				mu.Lock()
+				results[r.Name] = &ReleaseResult{Release: r, Files: files, Err: err}
+				mu.Unlock()
+			}(r)
+		}
+		wg.Wait()
+	}
+
+	failures := map[string]error{}
+	for name, res := range results {
+		if res.Err != nil {
+			failures[name] = res.Err
+		}
+	}
+	if len(failures) > 0 {
+		return results, &ReleaseError{Failures: failures}
+	}
+	return results, nil
+}
+
+// WriteReleaseTree writes the rendered manifests of results to
+// outDir/<namespace>/<release>/<file>, mirroring how the files were named by
+// RenderChart for each release.
+func WriteReleaseTree(results map[string]*ReleaseResult, outDir string) error {
+	for _, res := range results {
+		if res.Err != nil {
+			continue
+		}
+		dir := filepath.Join(outDir, res.Release.Namespace, res.Release.ReleaseName)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return errors.Wrapf(err, "failed to create directory %s", dir)
+		}
+		for name, manifest := range res.Files {
+			cleaned := filepath.Clean(filepath.FromSlash(name))
+			if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) || filepath.IsAbs(cleaned) {
+				return errors.Errorf("refusing to write manifest %q for release %q: path escapes %s", name, res.Release.Name, dir)
+			}
+			path := filepath.Join(dir, cleaned)
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return errors.Wrapf(err, "failed to create directory %s", filepath.Dir(path))
+			}
+			if err := os.WriteFile(path, []byte(manifest), 0o644); err != nil {
+				return errors.Wrapf(err, "failed to write %s", path)
+			}
+		}
+	}
+	return nil
+}
+
+// failedNeed returns the name of the first need of r that failed to render,
+// or "" if all of r's dependencies rendered successfully.
+func failedNeed(r ReleaseSpec, results map[string]*ReleaseResult) string {
+	for _, need := range r.Needs {
+		if res, ok := results[need]; ok && res.Err != nil {
+			return need
+		}
+	}
+	return ""
+}
+
+// batchByNeeds groups releases into ordered batches such that every release
+// in a batch only depends on releases in earlier batches, so each batch can
+// be rendered concurrently. It returns an error on an unknown or cyclic
+// dependency.
+func batchByNeeds(releases []ReleaseSpec) ([][]string, error) {
+	byName := make(map[string]ReleaseSpec, len(releases))
+	for _, r := range releases {
+		byName[r.Name] = r
+	}
+	for _, r := range releases {
+		for _, need := range r.Needs {
+			if _, ok := byName[need]; !ok {
+				return nil, errors.Errorf("release %q needs unknown release %q", r.Name, need)
+			}
+		}
+	}
+
+	var batches [][]string
+	done := map[string]bool{}
+	for len(done) < len(releases) {
+		var batch []string
+		for _, r := range releases {
+			if done[r.Name] {
+				continue
+			}
+			ready := true
+			for _, need := range r.Needs {
+				if !done[need] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				batch = append(batch, r.Name)
+			}
+		}
+		if len(batch) == 0 {
+			return nil, errors.New("cyclic or unsatisfiable needs: between releases")
+		}
+		for _, name := range batch {
+			done[name] = true
+		}
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/provenance"
+)
+
+var (
+	// verifyProv, when true, makes RenderChart fail closed unless the chart it
+	// loads from vendorDir carries a valid .prov signature against keyringPath.
+	//
+	// Note: this verifies the tarball Vendor() wrote under vendorDir, not the
+	// original upstream release artifact — lib.DefaultRegistry.GetChart only
+	// hands back an already-unpacked *chart.Chart, so the only bytes we can
+	// meaningfully sign and check here are the ones we ourselves repackaged
+	// when vendoring. Treat this as "did the vendored copy change since it was
+	// signed", not "is this the chart maintainer's exact published artifact".
+	verifyProv bool
+	// keyringPath is the PGP keyring consulted by VerifyVendoredChart.
+	keyringPath string
+)
+
+// VerifyVendoredChart verifies the .prov file that sits next to chartPath
+// (chartPath + ".prov") against keyring, failing if the file is missing, the
+// signature doesn't verify, or the chart's digest doesn't match.
+func VerifyVendoredChart(chartPath, keyring string) error {
+	if keyring == "" {
+		return errors.New("provenance verification requested but no keyring configured")
+	}
+	if _, err := downloader.VerifyChart(chartPath, keyring); err != nil {
+		return errors.Wrapf(err, "provenance verification failed for %s", chartPath)
+	}
+	return nil
+}
+
+// ChartComponent is a single entry in an SBOM: either the root chart, one of
+// its subchart dependencies, or a container image referenced by the rendered
+// manifests.
+type ChartComponent struct {
+	Type    string `json:"type"` // "chart" or "container"
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+// SBOM is a minimal CycloneDX-shaped bill of materials for a rendered chart:
+// enough to answer "what chart, which subcharts, and which images does this
+// release deploy".
+type SBOM struct {
+	BOMFormat   string           `json:"bomFormat"`
+	SpecVersion string           `json:"specVersion"`
+	Component   ChartComponent   `json:"component"`
+	Components  []ChartComponent `json:"components"`
+}
+
+// imageRefRegex matches the value of a pod spec `image:` field in rendered
+// YAML manifests. It's intentionally simple: it looks for the YAML key and
+// captures the rest of the line, which covers the overwhelming majority of
+// chart templates without needing a full YAML/Kubernetes-object decode.
+var imageRefRegex = regexp.MustCompile(`(?m)^\s*image:\s*"?([^"\s#]+)"?\s*$`)
+
+// GenerateSBOM builds an SBOM for chrt and the manifests RenderChart produced
+// for it, listing every subchart dependency and every container image
+// referenced by the rendered manifests.
+func GenerateSBOM(chrt *chart.Chart, files map[string]string) (*SBOM, error) {
+	sbom := &SBOM{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.5",
+		Component: ChartComponent{
+			Type:    "chart",
+			Name:    chrt.Name(),
+			Version: chrt.Metadata.Version,
+		},
+	}
+
+	for _, dep := range chrt.Dependencies() {
+		digest, err := chartDigest(dep)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to digest subchart %s", dep.Name())
+		}
+		sbom.Components = append(sbom.Components, ChartComponent{
+			Type:    "chart",
+			Name:    dep.Name(),
+			Version: dep.Metadata.Version,
+			Digest:  digest,
+		})
+	}
+
+	images := map[string]bool{}
+	for _, manifest := range files {
+		for _, m := range imageRefRegex.FindAllStringSubmatch(manifest, -1) {
+			images[m[1]] = true
+		}
+	}
+	imageNames := make([]string, 0, len(images))
+	for image := range images {
+		imageNames = append(imageNames, image)
+	}
+	sort.Strings(imageNames)
+	for _, image := range imageNames {
+		sbom.Components = append(sbom.Components, ChartComponent{Type: "container", Name: image})
+	}
+
+	return sbom, nil
+}
+
+// chartDigest packages an in-memory chart into a throwaway tarball just long
+// enough to hash it, so subchart entries in the SBOM carry a content digest
+// rather than just a version string.
+func chartDigest(ch *chart.Chart) (string, error) {
+	dir, err := os.MkdirTemp("", "helm-template-demo-sbom-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	path, err := chartutil.Save(ch, dir)
+	if err != nil {
+		return "", err
+	}
+	sum, err := provenance.DigestFile(path)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + sum, nil
+}
@@ -0,0 +1,293 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+	"kubepack.dev/kubepack/pkg/lib"
+	"kubepack.dev/lib-helm/pkg/action"
+	"kubepack.dev/lib-helm/pkg/values"
+	"sigs.k8s.io/yaml"
+)
+
+// RenderRequest is the body of POST /v1/render.
+type RenderRequest struct {
+	URL         string                 `json:"url"`
+	Name        string                 `json:"name"`
+	Version     string                 `json:"version"`
+	Namespace   string                 `json:"namespace"`
+	ReleaseName string                 `json:"releaseName"`
+	Values      map[string]interface{} `json:"values,omitempty"`
+}
+
+// renderCache is a bounded, in-memory LRU cache of rendered manifests, keyed
+// by the chart coordinates and a digest of the requested values so that a
+// repeated identical request from a dashboard is served without re-rendering
+// the chart while its entry is still cached.
+type renderCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type renderCacheEntry struct {
+	key   string
+	files map[string]string
+}
+
+func newRenderCache(capacity int) *renderCache {
+	return &renderCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (c *renderCache) get(key string) (map[string]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*renderCacheEntry).files, true
+}
+
+func (c *renderCache) add(key string, files map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*renderCacheEntry).files = files
+		return
+	}
+
+	el := c.ll.PushFront(&renderCacheEntry{key: key, files: files})
+	c.items[key] = el
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*renderCacheEntry).key)
+	}
+}
+
+func renderCacheKey(req RenderRequest) (string, error) {
+	valuesJSON, err := json.Marshal(req.Values)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(valuesJSON)
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%x", req.URL, req.Name, req.Version, req.Namespace, req.ReleaseName, sum), nil
+}
+
+// Server wraps RenderChart as an HTTP service, for UIs that want to preview
+// chart templates without shelling out to helm.
+type Server struct {
+	cache   *renderCache
+	timeout time.Duration
+}
+
+// NewServer returns a Server whose render cache holds at most cacheSize
+// entries, and whose requests are aborted after timeout.
+func NewServer(cacheSize int, timeout time.Duration) *Server {
+	return &Server{
+		cache:   newRenderCache(cacheSize),
+		timeout: timeout,
+	}
+}
+
+// Handler returns the http.Handler for the service, with a per-request
+// timeout applied.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/render", s.handleRender)
+	mux.HandleFunc("/v1/charts/", s.handleCharts)
+	return http.TimeoutHandler(mux, s.timeout, "request timed out")
+}
+
+func (s *Server) handleRender(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only POST is supported"))
+		return
+	}
+
+	var req RenderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid request body"))
+		return
+	}
+
+	key, err := renderCacheKey(req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if files, ok := s.cache.get(key); ok {
+		klog.InfoS("render cache hit", "url", req.URL, "name", req.Name, "version", req.Version, "duration", time.Since(start))
+		writeJSON(w, http.StatusOK, files)
+		return
+	}
+
+	valuesJSON, err := json.Marshal(req.Values)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid values"))
+		return
+	}
+
+	opts := &action.InstallOptions{
+		ChartURL:    req.URL,
+		ChartName:   req.Name,
+		Version:     req.Version,
+		Namespace:   req.Namespace,
+		ReleaseName: req.ReleaseName,
+		Values:      values.Options{ValuesPatch: &runtime.RawExtension{Raw: valuesJSON}},
+		ClientOnly:  true,
+		DryRun:      true,
+		Replace:     true,
+		SkipCRDs:    true,
+	}
+
+	_, files, err := RenderChart(&RenderOptions{InstallOptions: opts})
+	if err != nil {
+		klog.ErrorS(err, "render failed", "url", req.URL, "name", req.Name, "version", req.Version)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.cache.add(key, files)
+	klog.InfoS("render completed", "url", req.URL, "name", req.Name, "version", req.Version, "duration", time.Since(start))
+	writeJSON(w, http.StatusOK, files)
+}
+
+// handleCharts serves:
+//
+//	GET /v1/charts/{repo}/{name}/versions
+//	GET /v1/charts/{repo}/{name}/{version}/values
+//
+// where {repo} is the URL-escaped chart repository URL.
+func (s *Server) handleCharts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("only GET is supported"))
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/charts/"), "/")
+	repo, err := neturl.QueryUnescape(parts[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid repo"))
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && parts[2] == "versions":
+		s.handleVersions(w, repo, parts[1])
+	case len(parts) == 4 && parts[3] == "values":
+		s.handleValues(w, repo, parts[1], parts[2])
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown route"))
+	}
+}
+
+func (s *Server) handleVersions(w http.ResponseWriter, repo, name string) {
+	versions, err := chartVersions(repo, name)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, versions)
+}
+
+func (s *Server) handleValues(w http.ResponseWriter, repo, name, version string) {
+	chrt, err := lib.DefaultRegistry.GetChart(repo, name, version)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, chrt.Chart.Values)
+}
+
+// chartIndex is the subset of a Helm repo's index.yaml needed to list a
+// chart's available versions.
+type chartIndex struct {
+	Entries map[string][]struct {
+		Version string `json:"version"`
+	} `json:"entries"`
+}
+
+func chartVersions(repo, name string) ([]string, error) {
+	indexURL := strings.TrimSuffix(repo, "/") + "/index.yaml"
+	resp, err := http.Get(indexURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s", indexURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch %s: %s", indexURL, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var idx chartIndex
+	if err := yaml.Unmarshal(body, &idx); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", indexURL)
+	}
+
+	entries, ok := idx.Entries[name]
+	if !ok {
+		return nil, errors.Errorf("no chart named %q in %s", name, repo)
+	}
+	versions := make([]string, 0, len(entries))
+	for _, e := range entries {
+		versions = append(versions, e.Version)
+	}
+	return versions, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}